@@ -1,16 +1,33 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math/bits"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"net/url"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 // json to eventually save results to json output in future
@@ -34,6 +51,187 @@ type FileMetrics struct {
 	CountTags               string `json:"count-tags"`
 	KeepReason              string `json:"keepreason"`
 	IsInteresting	        bool `json:"interesting"`
+	Tags                    []string            `json:"tags,omitempty"`
+	Matches                 map[string][]string `json:"matches,omitempty"`
+	SimHash                 uint64              `json:"simhash,omitempty"`
+}
+
+// Rule is a single user-defined scraper/matcher rule loaded from a -rules
+// directory, modelled on ffuf's scraper config: a target to search, a
+// pattern to look for, and an action to take when it fires.
+type Rule struct {
+	Name    string `json:"name"`
+	Target  string `json:"target"` // "headers", "body", "url" or "all"
+	Type    string `json:"type"`   // "regex" or "literal"
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"` // "tag", "keep" or "interesting"
+
+	re *regexp.Regexp
+}
+
+func (r Rule) findAll(target string) []string {
+	if target == "" {
+		return nil
+	}
+	if r.Type == "literal" {
+		if strings.Contains(target, r.Pattern) {
+			return []string{r.Pattern}
+		}
+		return nil
+	}
+	if r.re == nil {
+		return nil
+	}
+	return r.re.FindAllString(target, -1)
+}
+
+// loadRules walks dir and parses every .json/.yaml/.yml file into a flat
+// list of Rules. Other files in the directory are ignored.
+func loadRules(dir string) ([]Rule, error) {
+	var rules []Rule
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading rule file %s: %w", path, err)
+		}
+
+		var fileRules []Rule
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			if err := json.Unmarshal(data, &fileRules); err != nil {
+				return fmt.Errorf("parsing rule file %s: %w", path, err)
+			}
+		case ".yaml", ".yml":
+			fileRules, err = parseYAMLRules(data)
+			if err != nil {
+				return fmt.Errorf("parsing rule file %s: %w", path, err)
+			}
+		default:
+			return nil
+		}
+		rules = append(rules, fileRules...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rules {
+		if rules[i].Type == "regex" {
+			re, err := regexp.Compile(rules[i].Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: invalid pattern %q: %w", rules[i].Name, rules[i].Pattern, err)
+			}
+			rules[i].re = re
+		}
+	}
+
+	return rules, nil
+}
+
+// parseYAMLRules understands the flat "- name: ... / target: ... / ..."
+// rule list shape used by this package, without pulling in a YAML
+// dependency. It does not attempt to support general YAML.
+func parseYAMLRules(data []byte) ([]Rule, error) {
+	var rules []Rule
+	var cur *Rule
+
+	for _, rawLine := range strings.Split(string(data), "\n") {
+		line := strings.TrimRight(rawLine, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(strings.TrimLeft(line, " "), "- ") {
+			if cur != nil {
+				rules = append(rules, *cur)
+			}
+			cur = &Rule{}
+			trimmed = strings.TrimPrefix(strings.TrimLeft(line, " "), "- ")
+		}
+		if cur == nil {
+			continue
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		switch strings.TrimSpace(key) {
+		case "name":
+			cur.Name = value
+		case "target":
+			cur.Target = value
+		case "type":
+			cur.Type = value
+		case "pattern":
+			cur.Pattern = value
+		case "action":
+			cur.Action = value
+		}
+	}
+	if cur != nil {
+		rules = append(rules, *cur)
+	}
+	return rules, nil
+}
+
+// ApplyRules runs every rule against the parts of a response it targets,
+// recording tags and matches on metrics. It reports whether any matching
+// rule's action is "keep", meaning the file must never be deduplicated away.
+func ApplyRules(rules []Rule, metrics *FileMetrics, headers, body, url string) bool {
+	keep := false
+
+	for _, rule := range rules {
+		var candidates []string
+		switch rule.Target {
+		case "headers":
+			candidates = []string{headers}
+		case "body":
+			candidates = []string{body}
+		case "url":
+			candidates = []string{url}
+		case "all":
+			candidates = []string{headers, body, url}
+		default:
+			continue
+		}
+
+		var found []string
+		for _, candidate := range candidates {
+			found = append(found, rule.findAll(candidate)...)
+		}
+		if len(found) == 0 {
+			continue
+		}
+
+		if metrics.Matches == nil {
+			metrics.Matches = make(map[string][]string)
+		}
+		metrics.Matches[rule.Name] = append(metrics.Matches[rule.Name], found...)
+
+		switch rule.Action {
+		case "tag":
+			metrics.Tags = append(metrics.Tags, rule.Name)
+		case "interesting":
+			metrics.IsInteresting = true
+		case "keep":
+			metrics.KeepReason = rule.Name
+			keep = true
+		}
+	}
+
+	return keep
 }
 
 
@@ -136,6 +334,134 @@ func CountHeaders(headerString string) string {
 	return strconv.Itoa(len(headerRegex.FindAllString(headerString, -1)))
 }
 
+// parsedResponse is what parseResponse extracts from a real net/http
+// response, ready to drop into a FileMetrics.
+type parsedResponse struct {
+	HeadersText      string
+	Body             string
+	Status           string
+	ContentType      string
+	RedirectLocation string
+	CountHeaders     string
+}
+
+// parseResponse strips meg's request-echo prefix from content and parses
+// what remains as a real HTTP response via net/http, so headers and the
+// body are read correctly regardless of multi-line headers, colons in
+// header values, or chunked transfer framing. A gzipped body (per
+// Content-Encoding) is inflated before metrics are computed over it. It
+// reports ok == false for captures net/http can't make sense of, so the
+// caller can fall back to the old line-scanning parser.
+func parseResponse(content string) (parsedResponse, bool) {
+	block := megResponseBlock(content)
+
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(block)), nil)
+	if err != nil {
+		return parsedResponse{}, false
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return parsedResponse{}, false
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		if gzr, err := gzip.NewReader(bytes.NewReader(bodyBytes)); err == nil {
+			if decoded, err := io.ReadAll(gzr); err == nil {
+				bodyBytes = decoded
+			}
+			gzr.Close()
+		}
+	}
+
+	var headerBuf bytes.Buffer
+	resp.Header.Write(&headerBuf)
+
+	headerCount := 0
+	for _, values := range resp.Header {
+		headerCount += len(values)
+	}
+
+	return parsedResponse{
+		HeadersText:      headerBuf.String(),
+		Body:             string(bodyBytes),
+		Status:           strconv.Itoa(resp.StatusCode),
+		ContentType:      resp.Header.Get("Content-Type"),
+		RedirectLocation: resp.Header.Get("Location"),
+		CountHeaders:     strconv.Itoa(headerCount),
+	}, true
+}
+
+// megResponseBlock finds where meg's response section starts (after the
+// request echo) and, if meg wrote it in verbose mode with a "< " marker
+// on every line, strips that marker so the result is a plain HTTP
+// response net/http can parse.
+func megResponseBlock(content string) string {
+	block := content
+	var prev rune
+	for i, c := range content {
+		if prev == '\n' && c == '<' {
+			block = content[i:]
+			break
+		}
+		prev = c
+	}
+
+	if !strings.HasPrefix(block, "< ") && !strings.Contains(block, "\n< ") {
+		return block
+	}
+
+	var stripped strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(block))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(block)+1)
+	for scanner.Scan() {
+		stripped.WriteString(strings.TrimPrefix(scanner.Text(), "< "))
+		stripped.WriteByte('\n')
+	}
+	return stripped.String()
+}
+
+// parseRequestURL reconstructs the URL meg captured for this response from
+// its "> "-prefixed request echo (meg's verbose mode): the path from the
+// request line and the host from the Host header. It returns "" if the
+// capture has no request echo to read (e.g. non-verbose captures).
+func parseRequestURL(content string) string {
+	blockIdx := strings.Index(content, "\n<")
+	if blockIdx < 0 {
+		return ""
+	}
+	requestPart := content[:blockIdx+1]
+
+	var path, host string
+	first := true
+	scanner := bufio.NewScanner(strings.NewReader(requestPart))
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), "> ")
+		if first {
+			first = false
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				path = fields[1]
+			}
+			continue
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(name), "Host") {
+			host = strings.TrimSpace(value)
+		}
+	}
+
+	if path == "" {
+		return ""
+	}
+	if host == "" {
+		return path
+	}
+	return "http://" + host + path
+}
+
+// SeperateContentIntoHeadersAndBody is the legacy line-scanning parser,
+// kept as computeMetrics' fallback for captures parseResponse can't make
+// sense of.
 func SeperateContentIntoHeadersAndBody(Content string) (string, string) {
 
 	var prev rune
@@ -178,42 +504,63 @@ func SeperateContentIntoHeadersAndBody(Content string) (string, string) {
 	return HeaderString, BodyString
 }
 
-func computeMetrics(path string) (FileMetrics, error) {
+// computeMetrics parses the response at path and scores it against rules
+// (which may be empty). It returns the computed metrics and whether a
+// rule with action "keep" fired, meaning the file must never be
+// deduplicated away.
+func computeMetrics(path string, rules []Rule) (FileMetrics, bool, error) {
 	var metrics FileMetrics
 
 	file, err := os.Open(path)
 	if err != nil {
-		return metrics, err
+		return metrics, false, err
 	}
 	defer file.Close()
 
 	content := make([]byte, 1000000)
 	n, err := io.ReadFull(file, content)
 	if err != nil && err != io.ErrUnexpectedEOF {
-		return metrics, err
+		return metrics, false, err
 	}
 	content = content[:n]
+	raw := string(content)
 
-	Headers, Body := SeperateContentIntoHeadersAndBody(string(content))
+	metrics.Url = parseRequestURL(raw)
+
+	var Headers, Body string
+	if parsed, ok := parseResponse(raw); ok {
+		Headers, Body = parsed.HeadersText, parsed.Body
+		metrics.Status = parsed.Status
+		metrics.ContentType = parsed.ContentType
+		metrics.RedirectLocation = parsed.RedirectLocation
+		metrics.CountHeaders = parsed.CountHeaders
+	} else {
+		// Malformed capture net/http can't parse: fall back to the old
+		// line-scanning/regex parser.
+		Headers, Body = SeperateContentIntoHeadersAndBody(raw)
+		metrics.Status = GetStatus(Headers)
+		metrics.ContentType = GetContentType(Headers)
+		metrics.RedirectLocation = GetRedirectLocation(Headers)
+		metrics.CountHeaders = CountHeaders(Headers)
+	}
 
 	//println("Headers:")
 	//println(Headers)
 	//println("Body:")
 	//println(Body)
 
-	metrics.Status = GetStatus(Headers)
-	metrics.ContentType = GetContentType(Headers)
-	metrics.RedirectLocation = GetRedirectLocation(Headers)
 	metrics.RedirectDomain = ExtractRedirectDomain(metrics.RedirectLocation)
 	metrics.CountRedirectParameters = CountRedirectParameters(metrics.RedirectLocation)
 	metrics.IsInteresting = IsInterestingContent(Headers, Body)
-	metrics.CountHeaders = CountHeaders(Headers)
         metrics.LengthTitle = CalculateTitleLength(Body)
         metrics.WordsTitle = CalculateTitleWords(Body)
         metrics.CountCssFiles = CountCssFiles(Body)
         metrics.CountJsFiles = CountJsFiles(Body)
         metrics.CountTags = CountTags(metrics.ContentType, Body)
-	
+	metrics.SimHash = simHash(Body)
+
+	keep := ApplyRules(rules, &metrics, Headers, Body, metrics.Url)
+
 	scanner := bufio.NewScanner(file)
 	scanner.Split(bufio.ScanWords)
 	for scanner.Scan() {
@@ -221,10 +568,10 @@ func computeMetrics(path string) (FileMetrics, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return metrics, err
+		return metrics, keep, err
 	}
 
-	return metrics, nil
+	return metrics, keep, nil
 }
 
 func keyForMetrics(m FileMetrics) string {
@@ -236,55 +583,706 @@ func keyForMetrics(m FileMetrics) string {
 	return key
 }
 
-func main() {
+const simhashShingleSize = 4
+
+// simHash computes a 64-bit SimHash over overlapping k-word shingles of
+// body, so that near-identical bodies (e.g. an error page that only
+// differs by a timestamp) hash to nearby values instead of colliding
+// only on an exact match.
+func simHash(body string) uint64 {
+	words := strings.Fields(body)
 
-	if len(os.Args) < 2 {
-		log.Fatal("Usage: go run main.go <meg responses directory>")
+	var shingles []string
+	if len(words) <= simhashShingleSize {
+		if len(words) == 0 {
+			return 0
+		}
+		shingles = []string{strings.Join(words, " ")}
+	} else {
+		shingles = make([]string, 0, len(words)-simhashShingleSize+1)
+		for i := 0; i+simhashShingleSize <= len(words); i++ {
+			shingles = append(shingles, strings.Join(words[i:i+simhashShingleSize], " "))
+		}
 	}
-	rootDir := os.Args[1]
 
-	groupedFiles := make(map[string][]string)
+	var weights [64]int
+	h := fnv.New64()
+	for _, shingle := range shingles {
+		h.Reset()
+		h.Write([]byte(shingle))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<uint(bit)) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
 
-	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Printf("Error processing %s: %v", path, err)
-			return nil
+	var hash uint64
+	for bit := 0; bit < 64; bit++ {
+		if weights[bit] > 0 {
+			hash |= 1 << uint(bit)
 		}
+	}
+	return hash
+}
 
-		if info.IsDir() {
-			return nil
+// clusterBySimilarity buckets files by (Status, ContentType), then within
+// each bucket compares every file against one representative per cluster
+// formed so far (the cluster's first member) instead of every prior
+// member, keeping clustering O(n·b) per bucket even when a bucket holds
+// hundreds of thousands of files.
+func clusterBySimilarity(files []FileMetrics, threshold int) [][]FileMetrics {
+	buckets := make(map[string][]FileMetrics)
+	for _, m := range files {
+		key := m.Status + "|" + m.ContentType
+		buckets[key] = append(buckets[key], m)
+	}
+
+	var clusters [][]FileMetrics
+	for _, bucket := range buckets {
+		var bucketClusters [][]FileMetrics
+		for _, m := range bucket {
+			placed := false
+			for i, cluster := range bucketClusters {
+				if bits.OnesCount64(cluster[0].SimHash^m.SimHash) <= threshold {
+					bucketClusters[i] = append(cluster, m)
+					placed = true
+					break
+				}
+			}
+			if !placed {
+				bucketClusters = append(bucketClusters, []FileMetrics{m})
+			}
 		}
+		clusters = append(clusters, bucketClusters...)
+	}
+	return clusters
+}
 
-		metrics, err := computeMetrics(path)
-		if err != nil {
-			log.Printf("Error calculating metrics %s: %v", path, err)
-			return nil
+// splitRepresentative picks the cluster member with the shortest result
+// path as the survivor and returns it along with the rest of the cluster.
+func splitRepresentative(cluster []FileMetrics) (FileMetrics, []FileMetrics) {
+	kept := cluster[0]
+	for _, m := range cluster[1:] {
+		if len(m.Resultfile) < len(kept.Resultfile) {
+			kept = m
 		}
-		key := keyForMetrics(metrics)
-		groupedFiles[key] = append(groupedFiles[key], path)
+	}
 
-		return nil
+	duplicates := make([]FileMetrics, 0, len(cluster)-1)
+	for _, m := range cluster {
+		if m.Resultfile != kept.Resultfile {
+			duplicates = append(duplicates, m)
+		}
+	}
+	return kept, duplicates
+}
+
+// GroupReport describes a single dedup group for the -output report: the
+// file that was kept and every duplicate that was found alongside it.
+type GroupReport struct {
+	Key        string        `json:"key"`
+	Kept       string        `json:"kept"`
+	Duplicates []FileMetrics `json:"duplicates"`
+}
+
+func writeReportJSON(w io.Writer, groups []GroupReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(groups)
+}
+
+func writeReportNDJSON(w io.Writer, groups []GroupReport) error {
+	enc := json.NewEncoder(w)
+	for _, g := range groups {
+		if err := enc.Encode(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeReportCSV(w io.Writer, groups []GroupReport) error {
+	cw := csv.NewWriter(w)
+	defer cw.Flush()
+
+	header := []string{"key", "kept", "duplicate", "status", "length", "words", "lines", "content-type",
+		"redirectlocation", "host", "count-headers", "redirect-domain", "count-redirect-parameters",
+		"length-title", "words-title", "count-css-files", "count-js-files", "count-tags", "interesting",
+		"tags", "matches", "simhash"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		for _, dup := range g.Duplicates {
+			row := []string{g.Key, g.Kept, dup.Resultfile, dup.Status, strconv.Itoa(dup.Length), strconv.Itoa(dup.Words),
+				strconv.Itoa(dup.Lines), dup.ContentType, dup.RedirectLocation, dup.Host, dup.CountHeaders,
+				dup.RedirectDomain, dup.CountRedirectParameters, dup.LengthTitle, dup.WordsTitle, dup.CountCssFiles,
+				dup.CountJsFiles, dup.CountTags, strconv.FormatBool(dup.IsInteresting),
+				strings.Join(dup.Tags, "|"), formatMatchesCSV(dup.Matches), strconv.FormatUint(dup.SimHash, 16)}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return cw.Error()
+}
+
+// formatMatchesCSV renders a FileMetrics.Matches map as a single CSV-safe
+// field: rule names sorted for stable output, each followed by its matches
+// joined with "|", and rules separated by ";".
+func formatMatchesCSV(matches map[string][]string) string {
+	if len(matches) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(matches))
+	for name := range matches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+":"+strings.Join(matches[name], "|"))
+	}
+	return strings.Join(parts, ";")
+}
+
+func writeReport(outputPath, format string, groups []GroupReport) error {
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch format {
+	case "json":
+		return writeReportJSON(f, groups)
+	case "ndjson":
+		return writeReportNDJSON(f, groups)
+	case "csv":
+		return writeReportCSV(f, groups)
+	default:
+		return fmt.Errorf("unsupported -format %q (want json, csv or ndjson)", format)
+	}
+}
+
+// scanResult is what a scan worker hands back to the collector for a
+// single meg response file.
+type scanResult struct {
+	path    string
+	metrics FileMetrics
+	keep    bool
+	err     error
+}
+
+// scanWorker computes metrics for every path received on paths and sends
+// the outcome on results until paths is closed.
+func scanWorker(paths <-chan string, rules []Rule, results chan<- scanResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for path := range paths {
+		metrics, keep, err := computeMetrics(path, rules)
+		metrics.Resultfile = path
+		results <- scanResult{path: path, metrics: metrics, keep: keep, err: err}
+	}
+}
+
+// scanDirectory walks rootDir and computes metrics for every file using
+// workers concurrent goroutines, feeding a buffered path channel and
+// reducing results back on the caller's goroutine (a channel-based
+// reducer, so scanned/alwaysKeep never need a mutex). If progress is
+// non-nil it receives one line per second: files scanned, files/sec, and
+// the directory currently being walked. Files kept by a rule are
+// returned separately from the rest, which callers still need to group
+// for deduplication.
+// Sink decides what happens to a response file once a dedup decision has
+// been made about it: Keep is called on the survivor of a group/cluster,
+// Discard on everything else. Swapping the Sink is how megpost goes from
+// "delete duplicates outright" to safer recovery options.
+type Sink interface {
+	Keep(path string, m FileMetrics) error
+	Discard(path string, m FileMetrics) error
+}
+
+// DeleteSink removes discarded files outright. This is megpost's
+// original, default behavior.
+type DeleteSink struct{}
+
+func (DeleteSink) Keep(path string, m FileMetrics) error { return nil }
+
+func (DeleteSink) Discard(path string, m FileMetrics) error {
+	return os.Remove(path)
+}
+
+// MoveSink moves discarded files into QuarantineDir, preserving their
+// path relative to RootDir, instead of deleting them.
+type MoveSink struct {
+	RootDir       string
+	QuarantineDir string
+}
+
+func (MoveSink) Keep(path string, m FileMetrics) error { return nil }
+
+func (s MoveSink) Discard(path string, m FileMetrics) error {
+	rel, err := filepath.Rel(s.RootDir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	dest := filepath.Join(s.QuarantineDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dest); err != nil {
+		// QuarantineDir may be on a different filesystem, in which case
+		// Rename can't just relink the inode; fall back to copy+remove.
+		if copyErr := copyFile(path, dest); copyErr != nil {
+			return copyErr
+		}
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// copyFile copies src to dest, preserving src's permissions.
+func copyFile(src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// TarballSink streams discarded files into a single gzip-compressed tar
+// archive instead of deleting them, so a run can be audited afterwards.
+// It must be closed once scanning is done to flush the archive.
+type TarballSink struct {
+	RootDir string
+
+	mu   sync.Mutex
+	file *os.File
+	gzw  *gzip.Writer
+	tw   *tar.Writer
+}
+
+func NewTarballSink(rootDir, archivePath string) (*TarballSink, error) {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	gzw := gzip.NewWriter(file)
+	return &TarballSink{RootDir: rootDir, file: file, gzw: gzw, tw: tar.NewWriter(gzw)}, nil
+}
+
+func (s *TarballSink) Keep(path string, m FileMetrics) error { return nil }
+
+func (s *TarballSink) Discard(path string, m FileMetrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rel, err := filepath.Rel(s.RootDir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+
+	if err := s.tw.WriteHeader(&tar.Header{
+		Name:    rel,
+		Mode:    int64(info.Mode().Perm()),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(s.tw, f); err != nil {
+		return err
+	}
+	f.Close()
+
+	return os.Remove(path)
+}
+
+// Close flushes and closes the tar.gz archive. Safe to call even if no
+// files were ever discarded.
+func (s *TarballSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	twErr := s.tw.Close()
+	gzwErr := s.gzw.Close()
+	fileErr := s.file.Close()
+
+	if twErr != nil {
+		return twErr
+	}
+	if gzwErr != nil {
+		return gzwErr
+	}
+	return fileErr
+}
+
+// S3Sink uploads discarded files to an S3-compatible bucket via minio-go
+// before removing them locally, trading "gone forever" for "one bucket
+// listing away".
+type S3Sink struct {
+	RootDir string
+	Bucket  string
+
+	client *minio.Client
+}
+
+func NewS3Sink(rootDir, endpoint, bucket, accessKeyID, secretAccessKey, region string, useSSL bool) (*S3Sink, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
+		Secure: useSSL,
+		Region: region,
 	})
 	if err != nil {
-		log.Fatalf("Error searching: %v", err)
+		return nil, err
 	}
+	return &S3Sink{RootDir: rootDir, Bucket: bucket, client: client}, nil
+}
 
-	removed := 0
-	for key, files := range groupedFiles {
-		if len(files) > 1 {
-			fmt.Printf("Group %s contains %d files. To save: %s\n", key, len(files), files[0])
-			for _, dup := range files[1:] {
-				err := os.Remove(dup)
-				//_, err := os.Stat(dup)
-				if err != nil {
-					log.Printf("[-] Can't remove %s: %v", dup, err)
-				} else {
-					fmt.Printf("[*] Duplicate removed: %s\n", dup)
-					removed ++
+func (s *S3Sink) Keep(path string, m FileMetrics) error { return nil }
+
+func (s *S3Sink) Discard(path string, m FileMetrics) error {
+	rel, err := filepath.Rel(s.RootDir, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+
+	if _, err := s.client.FPutObject(context.Background(), s.Bucket, rel, path, minio.PutObjectOptions{}); err != nil {
+		return fmt.Errorf("uploading %s to s3://%s/%s: %w", path, s.Bucket, rel, err)
+	}
+
+	return os.Remove(path)
+}
+
+// dryRunSink wraps another Sink so Discard only reports what it would
+// have done. Keep is always a no-op, same as every real Sink's Keep.
+type dryRunSink struct{}
+
+func (dryRunSink) Keep(path string, m FileMetrics) error { return nil }
+
+func (dryRunSink) Discard(path string, m FileMetrics) error {
+	fmt.Printf("[dry-run] Would discard duplicate: %s\n", path)
+	return nil
+}
+
+// s3SinkOptions carries -s3-* flag values through to NewS3Sink.
+type s3SinkOptions struct {
+	endpoint        string
+	bucket          string
+	region          string
+	useSSL          bool
+	accessKeyID     string
+	secretAccessKey string
+}
+
+// newSink builds the Sink selected by -sink and a close func that must
+// be called once scanning is done (most sinks' close is a no-op).
+func newSink(name, rootDir, quarantineDir, tarballPath string, s3opts s3SinkOptions) (Sink, func() error, error) {
+	noopClose := func() error { return nil }
+
+	switch name {
+	case "", "delete":
+		return DeleteSink{}, noopClose, nil
+	case "move":
+		if quarantineDir == "" {
+			return nil, nil, fmt.Errorf("-sink move requires -quarantine <dir>")
+		}
+		if err := os.MkdirAll(quarantineDir, 0o755); err != nil {
+			return nil, nil, err
+		}
+		return MoveSink{RootDir: rootDir, QuarantineDir: quarantineDir}, noopClose, nil
+	case "tarball":
+		if tarballPath == "" {
+			return nil, nil, fmt.Errorf("-sink tarball requires -tarball <path>")
+		}
+		sink, err := NewTarballSink(rootDir, tarballPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, sink.Close, nil
+	case "s3":
+		if s3opts.bucket == "" {
+			return nil, nil, fmt.Errorf("-sink s3 requires -s3-bucket")
+		}
+		sink, err := NewS3Sink(rootDir, s3opts.endpoint, s3opts.bucket, s3opts.accessKeyID, s3opts.secretAccessKey, s3opts.region, s3opts.useSSL)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, noopClose, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown -sink %q (want delete, move, tarball or s3)", name)
+	}
+}
+
+func scanDirectory(rootDir string, rules []Rule, workers int, progress *log.Logger, sink Sink) ([]FileMetrics, []FileMetrics) {
+	paths := make(chan string, 1024)
+	results := make(chan scanResult, 1024)
+
+	go func() {
+		defer close(paths)
+		err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				log.Printf("Error processing %s: %v", path, err)
+				return nil
+			}
+			if info.IsDir() {
+				if progress != nil {
+					progress.Printf("walking dir=%s", path)
 				}
+				return nil
 			}
+			paths <- path
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error searching: %v", err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go scanWorker(paths, rules, results, &wg)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var scannedFiles []FileMetrics
+	var alwaysKeep []FileMetrics
+
+	scanned := 0
+	start := time.Now()
+	lastLog := start
+	for res := range results {
+		if res.err != nil {
+			log.Printf("Error calculating metrics %s: %v", res.path, res.err)
+			continue
+		}
+		scanned++
+
+		if progress != nil && time.Since(lastLog) >= time.Second {
+			rate := float64(scanned) / time.Since(start).Seconds()
+			progress.Printf("scanned=%d files/sec=%.1f dir=%s", scanned, rate, filepath.Dir(res.path))
+			lastLog = time.Now()
+		}
+
+		if res.keep {
+			fmt.Printf("[*] Keeping %s (rule: %s)\n", res.path, res.metrics.KeepReason)
+			if err := sink.Keep(res.path, res.metrics); err != nil {
+				log.Printf("[-] Can't keep %s: %v", res.path, err)
+			}
+			alwaysKeep = append(alwaysKeep, res.metrics)
+			continue
+		}
+
+		scannedFiles = append(scannedFiles, res.metrics)
+	}
+
+	if progress != nil {
+		progress.Printf("done scanned=%d files/sec=%.1f", scanned, float64(scanned)/time.Since(start).Seconds())
+	}
+
+	return scannedFiles, alwaysKeep
+}
+
+// dedupeExact groups files whose scalar metrics match exactly (see
+// keyForMetrics) and hands every duplicate but the first in each group to
+// sink.Discard.
+func dedupeExact(files []FileMetrics, sink Sink) ([]GroupReport, int) {
+	groupedFiles := make(map[string][]FileMetrics)
+	for _, m := range files {
+		key := keyForMetrics(m)
+		groupedFiles[key] = append(groupedFiles[key], m)
+	}
+
+	var groups []GroupReport
+	removed := 0
+	for key, group := range groupedFiles {
+		if len(group) < 2 {
+			continue
+		}
+		// Goroutine scheduling in scanDirectory's worker pool means group
+		// order isn't path order; sort so the kept survivor is
+		// deterministic across runs instead of depending on scheduler
+		// jitter.
+		sort.Slice(group, func(i, j int) bool { return group[i].Resultfile < group[j].Resultfile })
+		fmt.Printf("Group %s contains %d files. To save: %s\n", key, len(group), group[0].Resultfile)
+		if err := sink.Keep(group[0].Resultfile, group[0]); err != nil {
+			log.Printf("[-] Can't keep %s: %v", group[0].Resultfile, err)
+		}
+		groups = append(groups, GroupReport{Key: key, Kept: group[0].Resultfile, Duplicates: group[1:]})
+		removed += discardDuplicates(group[1:], sink)
+	}
+	return groups, removed
+}
+
+// dedupeSimilarity clusters files by SimHash instead of requiring an
+// exact scalar-metric match, so near-identical pages (e.g. an error page
+// that only differs by a timestamp) are still deduplicated. Files are
+// first bucketed by (Status, ContentType), then within each bucket
+// assigned to the first existing cluster within Hamming distance
+// threshold of that cluster's representative, so clustering stays
+// O(n·b) per bucket. The shortest-path file in each cluster survives.
+func dedupeSimilarity(files []FileMetrics, threshold int, sink Sink) ([]GroupReport, int) {
+	var groups []GroupReport
+	removed := 0
+	for _, cluster := range clusterBySimilarity(files, threshold) {
+		if len(cluster) < 2 {
+			continue
+		}
+		kept, duplicates := splitRepresentative(cluster)
+		key := fmt.Sprintf("simhash:%016x~%d", kept.SimHash, threshold)
+		fmt.Printf("Cluster %s contains %d files. To save: %s\n", key, len(cluster), kept.Resultfile)
+		if err := sink.Keep(kept.Resultfile, kept); err != nil {
+			log.Printf("[-] Can't keep %s: %v", kept.Resultfile, err)
+		}
+		groups = append(groups, GroupReport{Key: key, Kept: kept.Resultfile, Duplicates: duplicates})
+		removed += discardDuplicates(duplicates, sink)
+	}
+	return groups, removed
+}
+
+func discardDuplicates(duplicates []FileMetrics, sink Sink) int {
+	_, dryRun := sink.(dryRunSink)
+
+	discarded := 0
+	for _, dup := range duplicates {
+		if err := sink.Discard(dup.Resultfile, dup); err != nil {
+			log.Printf("[-] Can't discard %s: %v", dup.Resultfile, err)
+			continue
+		}
+		if dryRun {
+			continue
 		}
+		fmt.Printf("[*] Duplicate discarded: %s\n", dup.Resultfile)
+		discarded++
+	}
+	return discarded
+}
+
+func main() {
+
+	outputPath := flag.String("output", "", "write a structured report of groups and duplicates to this file")
+	format := flag.String("format", "json", "report format when -output is set: json, csv or ndjson")
+	dryRun := flag.Bool("dry-run", false, "only report duplicates, never remove files")
+	rulesDir := flag.String("rules", "", "directory of JSON/YAML scraper rules to tag, flag or force-keep files")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of concurrent workers scanning files")
+	logPath := flag.String("log", "", "write structured scan progress (files scanned, files/sec, current dir) to this file")
+	similarity := flag.Bool("similarity", false, "cluster near-duplicate responses by SimHash instead of requiring an exact metric match")
+	similarityThreshold := flag.Int("similarity-threshold", 3, "max Hamming distance between SimHashes to consider responses near-duplicates")
+	sinkName := flag.String("sink", "delete", "what to do with discarded duplicates: delete, move, tarball or s3")
+	quarantineDir := flag.String("quarantine", "", "destination directory for -sink move")
+	tarballPath := flag.String("tarball", "", "destination .tar.gz archive for -sink tarball")
+	s3Endpoint := flag.String("s3-endpoint", "s3.amazonaws.com", "endpoint for -sink s3")
+	s3Bucket := flag.String("s3-bucket", "", "bucket for -sink s3")
+	s3Region := flag.String("s3-region", "us-east-1", "region for -sink s3")
+	s3SSL := flag.Bool("s3-ssl", true, "use TLS for -sink s3")
+	s3AccessKeyID := flag.String("s3-access-key-id", os.Getenv("AWS_ACCESS_KEY_ID"), "access key id for -sink s3 (default: $AWS_ACCESS_KEY_ID)")
+	s3SecretAccessKey := flag.String("s3-secret-access-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "secret access key for -sink s3 (default: $AWS_SECRET_ACCESS_KEY)")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		log.Fatal("Usage: megpost [-output file] [-format json|csv|ndjson] [-dry-run] [-rules dir] [-workers N] [-log file] [-sink delete|move|tarball|s3] <meg responses directory>")
+	}
+	rootDir := flag.Arg(0)
+
+	if *workers < 1 {
+		log.Fatalf("-workers must be at least 1, got %d", *workers)
+	}
+
+	var rules []Rule
+	if *rulesDir != "" {
+		var err error
+		rules, err = loadRules(*rulesDir)
+		if err != nil {
+			log.Fatalf("Error loading rules from %s: %v", *rulesDir, err)
+		}
+	}
+
+	var progress *log.Logger
+	if *logPath != "" {
+		logFile, err := os.Create(*logPath)
+		if err != nil {
+			log.Fatalf("Error creating log file: %v", err)
+		}
+		defer logFile.Close()
+		progress = log.New(logFile, "", log.LstdFlags)
+	}
+
+	var sink Sink
+	var err error
+	closeSink := func() error { return nil }
+	if *dryRun {
+		sink = dryRunSink{}
+	} else {
+		sink, closeSink, err = newSink(*sinkName, rootDir, *quarantineDir, *tarballPath, s3SinkOptions{
+			endpoint:        *s3Endpoint,
+			bucket:          *s3Bucket,
+			region:          *s3Region,
+			useSSL:          *s3SSL,
+			accessKeyID:     *s3AccessKeyID,
+			secretAccessKey: *s3SecretAccessKey,
+		})
+		if err != nil {
+			log.Fatalf("Error configuring -sink %s: %v", *sinkName, err)
+		}
+	}
+	defer func() {
+		if err := closeSink(); err != nil {
+			log.Printf("Error closing -sink %s: %v", *sinkName, err)
+		}
+	}()
+
+	scannedFiles, alwaysKeep := scanDirectory(rootDir, rules, *workers, progress, sink)
+
+	var groups []GroupReport
+	var removed int
+	if *similarity {
+		groups, removed = dedupeSimilarity(scannedFiles, *similarityThreshold, sink)
+	} else {
+		groups, removed = dedupeExact(scannedFiles, sink)
 	}
 	fmt.Printf("[!] Removed %d files total\n", removed)
+	if len(alwaysKeep) > 0 {
+		fmt.Printf("[!] Kept %d files due to rule matches\n", len(alwaysKeep))
+	}
+
+	if *outputPath != "" {
+		if err := writeReport(*outputPath, *format, groups); err != nil {
+			log.Fatalf("Error writing report: %v", err)
+		}
+	}
 }
 